@@ -0,0 +1,99 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package errdefs defines a set of marker interfaces that classify node
+// container errors, modeled after Docker's own errdefs package. Callers
+// (HTTP handlers in particular) can use the Is* helpers below to pick an
+// appropriate response without resorting to string matching on error
+// messages or comparing against package-level sentinel values.
+package errdefs
+
+// ErrNotFound signals that the referenced node container config, pool
+// entry or image could not be found.
+type ErrNotFound interface {
+	NotFound()
+}
+
+// ErrConflict signals that the requested operation conflicts with the
+// current state, such as a container that is already running.
+type ErrConflict interface {
+	Conflict()
+}
+
+// ErrInvalidParameter signals that the caller supplied invalid input,
+// such as a config failing validation.
+type ErrInvalidParameter interface {
+	InvalidParameter()
+}
+
+// ErrUnavailable signals that a dependency the operation relies on, such
+// as the Docker daemon or an image registry, is temporarily unavailable.
+type ErrUnavailable interface {
+	Unavailable()
+}
+
+// ErrSystem signals an unclassified failure originating from the Docker
+// daemon or the underlying system, as opposed to bad caller input.
+type ErrSystem interface {
+	System()
+}
+
+// causer mirrors github.com/pkg/errors.Causer so that wrapped errors can
+// be unwrapped without importing that package directly.
+type causer interface {
+	Cause() error
+}
+
+// walk checks err itself against is, then unwraps through Cause() one
+// link at a time, checking each link in turn. Checking before unwrapping
+// is what lets it see wrapper types like notFound, which implement both
+// the marker interface and causer, without stepping past them straight
+// to their cause.
+func walk(err error, is func(error) bool) bool {
+	for err != nil {
+		if is(err) {
+			return true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		next := c.Cause()
+		if next == nil || next == err {
+			return false
+		}
+		err = next
+	}
+	return false
+}
+
+// IsNotFound returns true if err, or any error in its Cause() chain,
+// implements ErrNotFound.
+func IsNotFound(err error) bool {
+	return walk(err, func(e error) bool { _, ok := e.(ErrNotFound); return ok })
+}
+
+// IsConflict returns true if err, or any error in its Cause() chain,
+// implements ErrConflict.
+func IsConflict(err error) bool {
+	return walk(err, func(e error) bool { _, ok := e.(ErrConflict); return ok })
+}
+
+// IsInvalidParameter returns true if err, or any error in its Cause()
+// chain, implements ErrInvalidParameter.
+func IsInvalidParameter(err error) bool {
+	return walk(err, func(e error) bool { _, ok := e.(ErrInvalidParameter); return ok })
+}
+
+// IsUnavailable returns true if err, or any error in its Cause() chain,
+// implements ErrUnavailable.
+func IsUnavailable(err error) bool {
+	return walk(err, func(e error) bool { _, ok := e.(ErrUnavailable); return ok })
+}
+
+// IsSystem returns true if err, or any error in its Cause() chain,
+// implements ErrSystem.
+func IsSystem(err error) bool {
+	return walk(err, func(e error) bool { _, ok := e.(ErrSystem); return ok })
+}
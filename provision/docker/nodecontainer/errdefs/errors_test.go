@@ -0,0 +1,55 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package errdefs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsHelpers(t *testing.T) {
+	base := errors.New("boom")
+	cases := []struct {
+		name  string
+		err   error
+		check func(error) bool
+	}{
+		{"NotFound", NotFound(base), IsNotFound},
+		{"Conflict", Conflict(base), IsConflict},
+		{"InvalidParameter", InvalidParameter(base), IsInvalidParameter},
+		{"Unavailable", Unavailable(base), IsUnavailable},
+		{"System", System(base), IsSystem},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.check(tt.err) {
+				t.Fatalf("expected %s(%v) to be true", tt.name, tt.err)
+			}
+		})
+	}
+}
+
+func TestIsHelpersDoNotCrossClassify(t *testing.T) {
+	err := NotFound(errors.New("boom"))
+	if IsConflict(err) || IsInvalidParameter(err) || IsUnavailable(err) || IsSystem(err) {
+		t.Fatalf("NotFound error misclassified as another kind: %#v", err)
+	}
+}
+
+func TestIsHelpersFalseOnPlainError(t *testing.T) {
+	err := errors.New("boom")
+	if IsNotFound(err) || IsConflict(err) || IsInvalidParameter(err) || IsUnavailable(err) || IsSystem(err) {
+		t.Fatalf("plain error should not match any classification: %#v", err)
+	}
+}
+
+func TestNilIsNoOp(t *testing.T) {
+	if NotFound(nil) != nil {
+		t.Fatalf("NotFound(nil) should return nil")
+	}
+	if IsNotFound(nil) {
+		t.Fatalf("IsNotFound(nil) should be false")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package errdefs
+
+type wrapped struct {
+	cause error
+}
+
+func (w wrapped) Error() string { return w.cause.Error() }
+func (w wrapped) Cause() error  { return w.cause }
+
+type notFound struct{ wrapped }
+
+func (notFound) NotFound() {}
+
+// NotFound classifies err as an ErrNotFound. Returns nil if err is nil.
+func NotFound(err error) error {
+	if err == nil {
+		return nil
+	}
+	return notFound{wrapped{err}}
+}
+
+type conflict struct{ wrapped }
+
+func (conflict) Conflict() {}
+
+// Conflict classifies err as an ErrConflict. Returns nil if err is nil.
+func Conflict(err error) error {
+	if err == nil {
+		return nil
+	}
+	return conflict{wrapped{err}}
+}
+
+type invalidParameter struct{ wrapped }
+
+func (invalidParameter) InvalidParameter() {}
+
+// InvalidParameter classifies err as an ErrInvalidParameter. Returns nil
+// if err is nil.
+func InvalidParameter(err error) error {
+	if err == nil {
+		return nil
+	}
+	return invalidParameter{wrapped{err}}
+}
+
+type unavailable struct{ wrapped }
+
+func (unavailable) Unavailable() {}
+
+// Unavailable classifies err as an ErrUnavailable. Returns nil if err is
+// nil.
+func Unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return unavailable{wrapped{err}}
+}
+
+type system struct{ wrapped }
+
+func (system) System() {}
+
+// System classifies err as an ErrSystem. Returns nil if err is nil.
+func System(err error) error {
+	if err == nil {
+		return nil
+	}
+	return system{wrapped{err}}
+}
@@ -6,19 +6,22 @@ package nodecontainer
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/tsuru/docker-cluster/cluster"
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/net"
 	"github.com/tsuru/tsuru/provision/docker/fix"
+	"github.com/tsuru/tsuru/provision/docker/nodecontainer/errdefs"
 	"github.com/tsuru/tsuru/scopedconfig"
+	"gopkg.in/mgo.v2"
 )
 
 const (
@@ -53,10 +56,10 @@ func (l NodeContainerConfigGroupSlice) Less(i, j int) bool { return l[i].Name <
 
 func (c *NodeContainerConfig) validate(pool string) error {
 	if c.Name == "" {
-		return ValidationErr{message: "node container config name cannot be empty"}
+		return errdefs.InvalidParameter(ValidationErr{message: "node container config name cannot be empty"})
 	}
 	if c.Config.Image != "" && pool != "" {
-		return ValidationErr{message: "it's not possible to override image in pool, please set image as a default value"}
+		return errdefs.InvalidParameter(ValidationErr{message: "it's not possible to override image in pool, please set image as a default value"})
 	}
 	return nil
 }
@@ -66,7 +69,10 @@ func AddNewContainer(pool string, c *NodeContainerConfig) error {
 		return err
 	}
 	conf := configFor(c.Name)
-	return conf.Save(pool, c)
+	if err := conf.Save(pool, c); err != nil {
+		return errdefs.System(err)
+	}
+	return nil
 }
 
 func UpdateContainer(pool string, c *NodeContainerConfig) error {
@@ -74,12 +80,30 @@ func UpdateContainer(pool string, c *NodeContainerConfig) error {
 		return err
 	}
 	conf := configFor(c.Name)
-	return conf.SaveMerge(pool, c)
+	if err := conf.SaveMerge(pool, c); err != nil {
+		return errdefs.System(err)
+	}
+	return nil
+}
+
+// classifyLoadError tells a real "no such config" from any other failure
+// scopedconfig/mgo might return (connection drop, backend outage), so
+// only the former gets classified as errdefs.NotFound - a transient
+// error here must not be reported as a 404 to callers using
+// errdefs.IsNotFound.
+func classifyLoadError(err error) error {
+	if err == mgo.ErrNotFound {
+		return errdefs.NotFound(err)
+	}
+	return errdefs.System(err)
 }
 
 func RemoveContainer(pool string, name string) error {
 	conf := configFor(name)
-	return conf.Remove(pool)
+	if err := conf.Remove(pool); err != nil {
+		return classifyLoadError(err)
+	}
+	return nil
 }
 
 func LoadNodeContainer(pool string, name string) (*NodeContainerConfig, error) {
@@ -87,7 +111,7 @@ func LoadNodeContainer(pool string, name string) (*NodeContainerConfig, error) {
 	var result NodeContainerConfig
 	err := conf.Load(pool, &result)
 	if err != nil {
-		return nil, err
+		return nil, classifyLoadError(err)
 	}
 	return &result, nil
 }
@@ -125,15 +149,19 @@ func AllNodeContainers() ([]NodeContainerConfigGroup, error) {
 // RecreateContainers relaunch all node containers in the cluster for the given
 // DockerProvisioner, logging progress to the given writer.
 //
-// It assumes that the given writer is thread safe.
-func RecreateContainers(p DockerProvisioner, w io.Writer, nodes ...cluster.Node) error {
-	return ensureContainersStarted(p, w, true, nodes...)
+// It assumes that the given writer is thread safe. The given context can be
+// canceled to abort a slow rollout. opts controls how many nodes are rolled
+// at once, how unhealthy the rollout may get before it stops dispatching new
+// nodes, and per-node hooks; a nil opts uses sane defaults.
+func RecreateContainers(ctx context.Context, p DockerProvisioner, w io.Writer, opts *RolloutOptions, nodes ...cluster.Node) error {
+	return ensureContainersStarted(ctx, p, w, true, opts, nodes...)
 }
 
-func ensureContainersStarted(p DockerProvisioner, w io.Writer, relaunch bool, nodes ...cluster.Node) error {
+func ensureContainersStarted(ctx context.Context, p DockerProvisioner, w io.Writer, relaunch bool, opts *RolloutOptions, nodes ...cluster.Node) error {
 	if w == nil {
 		w = ioutil.Discard
 	}
+	opts = opts.withDefaults()
 	confNames, err := scopedconfig.FindAllScopedConfigNames(nodeContainerCollection)
 	if err != nil {
 		return err
@@ -144,46 +172,159 @@ func ensureContainersStarted(p DockerProvisioner, w io.Writer, relaunch bool, no
 			return err
 		}
 	}
-	errChan := make(chan error, len(nodes))
-	wg := sync.WaitGroup{}
 	log.Debugf("[node containers] recreating %d containers", len(nodes))
-	recreateContainer := func(node *cluster.Node, confName string) {
-		defer wg.Done()
-		pool := node.Metadata["pool"]
-		containerConfig, confErr := LoadNodeContainer(pool, confName)
-		if confErr != nil {
-			errChan <- confErr
-			return
-		}
-		log.Debugf("[node containers] recreating container %q in %s [%s]", confName, node.Address, pool)
-		fmt.Fprintf(w, "relaunching node container %q in the node %s [%s]\n", confName, node.Address, pool)
-		confErr = containerConfig.create(node.Address, pool, p, relaunch)
-		if confErr != nil {
-			msg := fmt.Sprintf("[node containers] failed to create container in %s [%s]: %s", node.Address, pool, confErr)
-			log.Error(msg)
-			errChan <- errors.New(msg)
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	abortThreshold := opts.abortThreshold(len(nodes))
+	var failedCount int32
+	var wMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.MaxParallel)
+	type nodeOutcome struct {
+		addr    string
+		skipped bool
+		err     error
 	}
+	outcomes := make(chan nodeOutcome, len(nodes))
 	for i := range nodes {
+		node := &nodes[i]
+		if ctx.Err() != nil {
+			outcomes <- nodeOutcome{addr: node.Address, skipped: true}
+			continue
+		}
 		wg.Add(1)
+		sem <- struct{}{}
 		go func(node *cluster.Node) {
 			defer wg.Done()
-			for j := range confNames {
-				wg.Add(1)
-				go recreateContainer(node, confNames[j])
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				outcomes <- nodeOutcome{addr: node.Address, skipped: true}
+				return
 			}
-		}(&nodes[i])
+			nodeErr := recreateNode(ctx, p, w, &wMu, relaunch, confNames, node, opts)
+			if nodeErr != nil {
+				if atomic.AddInt32(&failedCount, 1) >= int32(abortThreshold) {
+					cancel()
+				}
+			}
+			outcomes <- nodeOutcome{addr: node.Address, err: nodeErr}
+		}(node)
 	}
 	wg.Wait()
-	close(errChan)
-	var allErrors []string
-	for err = range errChan {
-		allErrors = append(allErrors, err.Error())
+	close(outcomes)
+	result := &RolloutError{Failed: map[string]error{}}
+	for o := range outcomes {
+		switch {
+		case o.skipped:
+			result.Skipped = append(result.Skipped, o.addr)
+		case o.err != nil:
+			result.Failed[o.addr] = o.err
+		default:
+			result.Succeeded = append(result.Succeeded, o.addr)
+		}
 	}
-	if len(allErrors) == 0 {
+	if len(result.Failed) == 0 && len(result.Skipped) == 0 {
 		return nil
 	}
-	return fmt.Errorf("multiple errors: %s", strings.Join(allErrors, ", "))
+	return result
+}
+
+// recreateNode (re)creates every node container config in confNames on a
+// single node, running opts.PreNode and opts.PostNode around the work and
+// waiting for each container to report itself healthy before moving on.
+func recreateNode(ctx context.Context, p DockerProvisioner, w io.Writer, wMu *sync.Mutex, relaunch bool, confNames []string, node *cluster.Node, opts *RolloutOptions) error {
+	pool := node.Metadata["pool"]
+	if opts.PreNode != nil {
+		if err := opts.PreNode(ctx, node); err != nil {
+			return err
+		}
+	}
+	cfg := loadRateLimitConfig(pool)
+	createSem := make(chan struct{}, cfg.MaxConcurrentCreates)
+	var confWG sync.WaitGroup
+	errs := make(chan error, len(confNames))
+	for _, confName := range confNames {
+		if ctx.Err() != nil {
+			break
+		}
+		confWG.Add(1)
+		createSem <- struct{}{}
+		go func(confName string) {
+			defer confWG.Done()
+			defer func() { <-createSem }()
+			// Each confName gets its own prefixedWriter (only the mutex
+			// and underlying writer are shared) so concurrent pulls on
+			// this node can never splice partial lines together.
+			confWriter := newPrefixedWriter(w, wMu, node.Address, pool, confName)
+			defer confWriter.Flush()
+			errs <- recreateNodeContainer(ctx, p, confWriter, relaunch, node, pool, confName, opts)
+		}(confName)
+	}
+	confWG.Wait()
+	close(errs)
+	var nodeErrors []error
+	for err := range errs {
+		if err != nil {
+			nodeErrors = append(nodeErrors, err)
+		}
+	}
+	if opts.PostNode != nil {
+		if err := opts.PostNode(ctx, node); err != nil {
+			nodeErrors = append(nodeErrors, err)
+		}
+	}
+	if len(nodeErrors) == 0 {
+		return nil
+	}
+	return &MultiError{Errors: nodeErrors}
+}
+
+func recreateNodeContainer(ctx context.Context, p DockerProvisioner, w io.Writer, relaunch bool, node *cluster.Node, pool, confName string, opts *RolloutOptions) error {
+	containerConfig, err := LoadNodeContainer(pool, confName)
+	if err != nil {
+		return err
+	}
+	log.Debugf("[node containers] recreating container %q in %s [%s]", confName, node.Address, pool)
+	fmt.Fprintf(w, "relaunching node container %q\n", confName)
+	err = containerConfig.create(ctx, node.Address, pool, p, relaunch, w)
+	if err != nil {
+		log.Errorf("[node containers] failed to create container in %s [%s]: %s", node.Address, pool, err)
+		fmt.Fprintf(w, "error creating container %q: %s\n", confName, err)
+		return wrapf(err, "failed to create container %q in %s [%s]: %s", confName, node.Address, pool, err)
+	}
+	return waitContainerHealthy(ctx, node.Address, containerConfig.Name, opts.HealthTimeout, w)
+}
+
+// wrappedError adds context to an error while keeping it inspectable
+// through Cause(), so an errdefs classification survives being wrapped
+// with extra detail such as which node or pool it happened on.
+type wrappedError struct {
+	msg   string
+	cause error
+}
+
+func (w *wrappedError) Error() string { return w.msg }
+func (w *wrappedError) Cause() error  { return w.cause }
+
+func wrapf(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), cause: err}
+}
+
+// MultiError aggregates the errors produced while (re)creating node
+// containers across a set of nodes. Unlike a plain joined string, it
+// keeps each original error intact so callers can still classify them
+// individually with errdefs.Is*, instead of string-matching the
+// aggregate message.
+type MultiError struct {
+	Errors []error
+}
+
+func (m *MultiError) Error() string {
+	msgs := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("multiple errors: %s", strings.Join(msgs, ", "))
 }
 
 func (c *NodeContainerConfig) EnvMap() map[string]string {
@@ -207,11 +348,18 @@ func (c *NodeContainerConfig) image() string {
 	return c.Config.Image
 }
 
-func (c *NodeContainerConfig) pullImage(client *docker.Client, p DockerProvisioner) (string, error) {
+func (c *NodeContainerConfig) pullImage(ctx context.Context, client *docker.Client, p DockerProvisioner, pool string, w io.Writer) (string, error) {
 	image := c.image()
-	output, err := pullWithRetry(client, p, image, 3)
+	if trustCfg := loadTrustConfig(pool); trustCfg != nil {
+		trustedImage, err := c.verifyImageTrust(ctx, trustCfg)
+		if err != nil {
+			return "", err
+		}
+		image = trustedImage
+	}
+	output, err := pullWithRetry(ctx, client, p, pool, image, w, 3)
 	if err != nil {
-		return "", err
+		return "", errdefs.Unavailable(err)
 	}
 	var pinnedImage string
 	if shouldPinImage(image) {
@@ -228,12 +376,18 @@ func (c *NodeContainerConfig) pullImage(client *docker.Client, p DockerProvision
 	return image, err
 }
 
-func (c *NodeContainerConfig) create(dockerEndpoint, poolName string, p DockerProvisioner, relaunch bool) error {
+func (c *NodeContainerConfig) create(ctx context.Context, dockerEndpoint, poolName string, p DockerProvisioner, relaunch bool, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
 	client, err := dockerClient(dockerEndpoint)
 	if err != nil {
-		return err
+		return errdefs.Unavailable(err)
 	}
-	c.Config.Image, err = c.pullImage(client, p)
+	c.Config.Image, err = c.pullImage(ctx, client, p, poolName, w)
 	if err != nil {
 		return err
 	}
@@ -243,21 +397,28 @@ func (c *NodeContainerConfig) create(dockerEndpoint, poolName string, p DockerPr
 		HostConfig: &c.HostConfig,
 		Config:     &c.Config,
 	}
+	fmt.Fprintf(w, "creating container %q\n", c.Name)
 	_, err = client.CreateContainer(opts)
 	if relaunch && err == docker.ErrContainerAlreadyExists {
 		err = client.RemoveContainer(docker.RemoveContainerOptions{ID: opts.Name, Force: true})
 		if err != nil {
-			return err
+			fmt.Fprintf(w, "error removing existing container %q: %s\n", c.Name, err)
+			return errdefs.Conflict(err)
 		}
 		_, err = client.CreateContainer(opts)
 	}
 	if err != nil && err != docker.ErrContainerAlreadyExists {
-		return err
+		fmt.Fprintf(w, "error creating container %q: %s\n", c.Name, err)
+		return errdefs.System(err)
 	}
 	err = client.StartContainer(c.Name, &c.HostConfig)
 	if _, ok := err.(*docker.ContainerAlreadyRunning); !ok {
-		return err
+		if err != nil {
+			fmt.Fprintf(w, "error starting container %q: %s\n", c.Name, err)
+		}
+		return errdefs.System(err)
 	}
+	fmt.Fprintf(w, "started\n")
 	return nil
 }
 
@@ -286,20 +447,48 @@ func dockerClient(endpoint string) (*docker.Client, error) {
 	return client, nil
 }
 
-func pullWithRetry(client *docker.Client, p DockerProvisioner, image string, maxTries int) (string, error) {
+func pullWithRetry(ctx context.Context, client *docker.Client, p DockerProvisioner, pool, image string, w io.Writer, maxTries int) (string, error) {
 	var buf bytes.Buffer
 	var err error
-	pullOpts := docker.PullImageOptions{Repository: image, OutputStream: &buf}
+	teeWriter := io.MultiWriter(w, &buf)
+	pullOpts := docker.PullImageOptions{Repository: image, OutputStream: teeWriter, RawJSONStream: true}
 	registryAuth := p.RegistryAuthConfig()
+	limiter := registryLimiterForPool(pool)
+	registry := registryFromImage(image)
+	backoff := initialPullBackoff
 	for ; maxTries > 0; maxTries-- {
+		if err = limiter.wait(ctx, registry); err != nil {
+			return "", err
+		}
+		buf.Reset()
 		err = client.PullImage(pullOpts, registryAuth)
 		if err == nil {
 			return buf.String(), nil
 		}
+		if maxTries == 1 {
+			break
+		}
+		if err = sleepWithContext(ctx, jittered(backoff)); err != nil {
+			return "", err
+		}
+		backoff *= 2
+		if backoff > maxPullBackoff {
+			backoff = maxPullBackoff
+		}
 	}
 	return "", err
 }
 
+// bootstrapRolloutOptions is used when a single new node joins the
+// cluster: there's only one node to process, so parallelism doesn't
+// matter and any failure should be reported rather than silently
+// tolerated as partial cluster unhealthiness.
+var bootstrapRolloutOptions = &RolloutOptions{
+	MaxParallel:          1,
+	MaxUnhealthyFraction: 1,
+	HealthTimeout:        defaultHealthProbeTimeout,
+}
+
 type ClusterHook struct {
 	Provisioner DockerProvisioner
 }
@@ -309,9 +498,9 @@ func (h *ClusterHook) RunClusterHook(evt cluster.HookEvent, node *cluster.Node)
 	if err != nil {
 		return fmt.Errorf("unable to initialize bs node container: %s", err)
 	}
-	err = ensureContainersStarted(h.Provisioner, nil, false, *node)
+	err = ensureContainersStarted(context.Background(), h.Provisioner, nil, false, bootstrapRolloutOptions, *node)
 	if err != nil {
-		return fmt.Errorf("unable to start node containers: %s", err)
+		return wrapf(err, "unable to start node containers: %s", err)
 	}
 	return nil
 }
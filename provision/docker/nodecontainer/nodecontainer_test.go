@@ -0,0 +1,41 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tsuru/tsuru/provision/docker/nodecontainer/errdefs"
+	"gopkg.in/mgo.v2"
+)
+
+func TestWrapfPreservesClassification(t *testing.T) {
+	base := errdefs.NotFound(errors.New("config missing"))
+	wrapped := wrapf(base, "failed to create container %q: %s", "bs", base)
+	if !errdefs.IsNotFound(wrapped) {
+		t.Fatalf("expected wrapf to preserve NotFound classification, got %#v", wrapped)
+	}
+	if wrapped.Error() == "" {
+		t.Fatalf("expected a non-empty message")
+	}
+}
+
+func TestClassifyLoadErrorNotFound(t *testing.T) {
+	err := classifyLoadError(mgo.ErrNotFound)
+	if !errdefs.IsNotFound(err) {
+		t.Fatalf("expected mgo.ErrNotFound to classify as NotFound, got %#v", err)
+	}
+}
+
+func TestClassifyLoadErrorOtherFailuresAreNotNotFound(t *testing.T) {
+	err := classifyLoadError(errors.New("connection refused"))
+	if errdefs.IsNotFound(err) {
+		t.Fatalf("expected a transient failure not to be classified as NotFound, got %#v", err)
+	}
+	if !errdefs.IsSystem(err) {
+		t.Fatalf("expected a transient failure to be classified as System, got %#v", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/tsuru/tsuru/scopedconfig"
+)
+
+const (
+	rateLimitCollection = "nodeContainerRateLimit"
+
+	defaultRegistry             = "docker.io"
+	defaultPullsPerSecond       = 2
+	defaultBurst                = 4
+	defaultMaxConcurrentCreates = 10
+
+	initialPullBackoff = 500 * time.Millisecond
+	maxPullBackoff     = 30 * time.Second
+
+	limiterConfigRefresh = 30 * time.Second
+)
+
+// RateLimitConfig controls how aggressively node containers are
+// recreated in a pool: how fast images may be pulled from each
+// registry, and how many containers may be created concurrently on a
+// single node. It's stored with scopedconfig so every pool can have its
+// own budget.
+type RateLimitConfig struct {
+	PullsPerSecond       float64
+	Burst                int
+	MaxConcurrentCreates int
+}
+
+func (r RateLimitConfig) withDefaults() RateLimitConfig {
+	if r.PullsPerSecond <= 0 {
+		r.PullsPerSecond = defaultPullsPerSecond
+	}
+	if r.Burst <= 0 {
+		r.Burst = defaultBurst
+	}
+	if r.MaxConcurrentCreates <= 0 {
+		r.MaxConcurrentCreates = defaultMaxConcurrentCreates
+	}
+	return r
+}
+
+func rateLimitConfigFor() *scopedconfig.ScopedConfig {
+	conf := scopedconfig.FindScopedConfigFor(rateLimitCollection, "rate-limit")
+	conf.Jsonfy = true
+	conf.AllowMapEmpty = true
+	return conf
+}
+
+// SaveRateLimitConfig persists the pull/create budget for the given
+// pool. An empty pool sets the default budget used by pools without a
+// specific override.
+func SaveRateLimitConfig(pool string, cfg RateLimitConfig) error {
+	return rateLimitConfigFor().Save(pool, &cfg)
+}
+
+func loadRateLimitConfig(pool string) RateLimitConfig {
+	var cfg RateLimitConfig
+	if err := rateLimitConfigFor().Load(pool, &cfg); err != nil {
+		return RateLimitConfig{}.withDefaults()
+	}
+	return cfg.withDefaults()
+}
+
+// registryLimiter hands out one token-bucket rate.Limiter per registry
+// hostname, so that a slow or overloaded registry only throttles pulls
+// against itself and not every other registry in use. Its rate and burst
+// are periodically re-read from the pool's RateLimitConfig, so an
+// operator tuning the budget live doesn't require a process restart to
+// take effect.
+type registryLimiter struct {
+	mu          sync.Mutex
+	limiters    map[string]*rate.Limiter
+	pool        string
+	limit       rate.Limit
+	burst       int
+	lastRefresh time.Time
+}
+
+func newRegistryLimiter(pool string, cfg RateLimitConfig) *registryLimiter {
+	return &registryLimiter{
+		limiters:    make(map[string]*rate.Limiter),
+		pool:        pool,
+		limit:       rate.Limit(cfg.PullsPerSecond),
+		burst:       cfg.Burst,
+		lastRefresh: time.Now(),
+	}
+}
+
+func (r *registryLimiter) wait(ctx context.Context, registry string) error {
+	return r.limiterFor(registry).Wait(ctx)
+}
+
+func (r *registryLimiter) limiterFor(registry string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshLocked()
+	l, ok := r.limiters[registry]
+	if !ok {
+		l = rate.NewLimiter(r.limit, r.burst)
+		r.limiters[registry] = l
+	}
+	return l
+}
+
+// refreshLocked re-reads the pool's RateLimitConfig every
+// limiterConfigRefresh and, if it changed, applies the new rate/burst to
+// every registry bucket already handed out. Callers must hold r.mu.
+func (r *registryLimiter) refreshLocked() {
+	if time.Since(r.lastRefresh) < limiterConfigRefresh {
+		return
+	}
+	r.lastRefresh = time.Now()
+	cfg := loadRateLimitConfig(r.pool)
+	newLimit := rate.Limit(cfg.PullsPerSecond)
+	if newLimit == r.limit && cfg.Burst == r.burst {
+		return
+	}
+	r.limit = newLimit
+	r.burst = cfg.Burst
+	for _, l := range r.limiters {
+		l.SetLimit(newLimit)
+		l.SetBurst(cfg.Burst)
+	}
+}
+
+var (
+	poolLimitersMu sync.Mutex
+	poolLimiters   = map[string]*registryLimiter{}
+)
+
+func registryLimiterForPool(pool string) *registryLimiter {
+	poolLimitersMu.Lock()
+	defer poolLimitersMu.Unlock()
+	l, ok := poolLimiters[pool]
+	if ok {
+		return l
+	}
+	l = newRegistryLimiter(pool, loadRateLimitConfig(pool))
+	poolLimiters[pool] = l
+	return l
+}
+
+// registryFromImage extracts the registry hostname an image reference
+// would be pulled from, following the same rule Docker itself uses:
+// the leading path segment only counts as a hostname when it looks like
+// one (it contains a "." or ":", or is literally "localhost");
+// otherwise the image comes from the default registry.
+func registryFromImage(image string) string {
+	name := image
+	if at := strings.IndexByte(name, '@'); at >= 0 {
+		name = name[:at]
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return defaultRegistry
+	}
+	host := parts[0]
+	if host == "localhost" || strings.ContainsAny(host, ".:") {
+		return host
+	}
+	return defaultRegistry
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jittered adds up to 50% of random jitter on top of d, so that many
+// nodes backing off at the same time don't retry in lockstep.
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
@@ -0,0 +1,28 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import "testing"
+
+func TestRegistryFromImage(t *testing.T) {
+	cases := []struct {
+		image string
+		want  string
+	}{
+		{"tsuru/bs", defaultRegistry},
+		{"tsuru/bs:v1", defaultRegistry},
+		{"registry.example.com/tsuru/bs", "registry.example.com"},
+		{"registry.example.com:5000/tsuru/bs", "registry.example.com:5000"},
+		{"localhost/tsuru/bs", "localhost"},
+		{"localhost:5000/tsuru/bs", "localhost:5000"},
+		{"bs", defaultRegistry},
+		{"registry.example.com/tsuru/bs@sha256:abcdef", "registry.example.com"},
+	}
+	for _, tt := range cases {
+		if got := registryFromImage(tt.image); got != tt.want {
+			t.Errorf("registryFromImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
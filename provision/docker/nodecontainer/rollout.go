@@ -0,0 +1,132 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/tsuru/provision/docker/nodecontainer/errdefs"
+)
+
+const (
+	defaultMaxParallelNodes     = 10
+	defaultMaxUnhealthyFraction = 0.5
+	defaultHealthProbeTimeout   = 2 * time.Minute
+	healthPollInterval          = 2 * time.Second
+)
+
+// NodeHookFunc runs before or after a single node is processed by a
+// rollout, e.g. to drain traffic from the node or to warm it back up.
+type NodeHookFunc func(ctx context.Context, node *cluster.Node) error
+
+// RolloutOptions configures how aggressively RecreateContainers rolls
+// node containers across a cluster: how many nodes are touched at once,
+// how unhealthy the rollout is allowed to get before it gives up on the
+// remaining nodes, and how long to wait for a freshly started container
+// to report itself healthy.
+type RolloutOptions struct {
+	// MaxParallel bounds how many nodes are recreated at the same time.
+	MaxParallel int
+	// MaxUnhealthyFraction is the fraction of nodes (0, 1] that may fail
+	// before the rollout cancels the nodes it hasn't started yet.
+	MaxUnhealthyFraction float64
+	// HealthTimeout bounds how long to wait, per container, for
+	// InspectContainer to report it Running and, when the image
+	// declares a Healthcheck, for Health.Status to become "healthy".
+	HealthTimeout time.Duration
+	// PreNode and PostNode, when set, run immediately before and after
+	// a node's containers are (re)created.
+	PreNode  NodeHookFunc
+	PostNode NodeHookFunc
+}
+
+func (o *RolloutOptions) withDefaults() *RolloutOptions {
+	var clone RolloutOptions
+	if o != nil {
+		clone = *o
+	}
+	if clone.MaxParallel <= 0 {
+		clone.MaxParallel = defaultMaxParallelNodes
+	}
+	if clone.MaxUnhealthyFraction <= 0 {
+		clone.MaxUnhealthyFraction = defaultMaxUnhealthyFraction
+	}
+	if clone.HealthTimeout <= 0 {
+		clone.HealthTimeout = defaultHealthProbeTimeout
+	}
+	return &clone
+}
+
+func (o *RolloutOptions) abortThreshold(nodeCount int) int {
+	threshold := int(math.Ceil(o.MaxUnhealthyFraction * float64(nodeCount)))
+	if threshold < 1 {
+		threshold = 1
+	}
+	return threshold
+}
+
+// RolloutError reports the outcome of a rollout that didn't fully
+// succeed: which nodes were recreated, which failed, and which were
+// skipped because the rollout aborted before reaching them.
+type RolloutError struct {
+	Succeeded []string
+	Failed    map[string]error
+	Skipped   []string
+}
+
+func (e *RolloutError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rollout finished with errors: %d succeeded, %d failed, %d skipped", len(e.Succeeded), len(e.Failed), len(e.Skipped))
+	if len(e.Failed) > 0 {
+		parts := make([]string, 0, len(e.Failed))
+		for addr, err := range e.Failed {
+			parts = append(parts, fmt.Sprintf("%s: %s", addr, err))
+		}
+		fmt.Fprintf(&b, " (failed: %s)", strings.Join(parts, ", "))
+	}
+	if len(e.Skipped) > 0 {
+		fmt.Fprintf(&b, " (skipped: %s)", strings.Join(e.Skipped, ", "))
+	}
+	return b.String()
+}
+
+// waitContainerHealthy polls InspectContainer until the named container
+// is Running and, if the image declares a Healthcheck, its Health.Status
+// is "healthy" - or until timeout elapses or ctx is canceled.
+func waitContainerHealthy(ctx context.Context, dockerEndpoint, name string, timeout time.Duration, w io.Writer) error {
+	client, err := dockerClient(dockerEndpoint)
+	if err != nil {
+		return errdefs.Unavailable(err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		container, err := client.InspectContainer(name)
+		if err != nil {
+			return errdefs.System(err)
+		}
+		if container.State.Running {
+			health := container.State.Health.Status
+			if health == "" || health == "healthy" {
+				fmt.Fprintf(w, "container %q healthy\n", name)
+				return nil
+			}
+			if health == "unhealthy" {
+				return errdefs.Unavailable(fmt.Errorf("container %q reported unhealthy", name))
+			}
+		}
+		if time.Now().After(deadline) {
+			return errdefs.Unavailable(fmt.Errorf("timed out after %s waiting for container %q to become healthy", timeout, name))
+		}
+		if err := sleepWithContext(ctx, healthPollInterval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import "testing"
+
+func TestAbortThreshold(t *testing.T) {
+	cases := []struct {
+		fraction  float64
+		nodeCount int
+		want      int
+	}{
+		{0.5, 10, 5},
+		{0.5, 1, 1},
+		{0.1, 1, 1},
+		{1, 10, 10},
+		{0.34, 3, 2},
+	}
+	for _, tt := range cases {
+		o := &RolloutOptions{MaxUnhealthyFraction: tt.fraction}
+		if got := o.abortThreshold(tt.nodeCount); got != tt.want {
+			t.Errorf("abortThreshold(%v, %d) = %d, want %d", tt.fraction, tt.nodeCount, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/docker-cluster/cluster"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/scopedconfig"
+)
+
+const (
+	eventDebounceWindow      = 5 * time.Second
+	eventReconnectBackoff    = 2 * time.Second
+	maxEventReconnectBackoff = time.Minute
+	eventListenerBufferSize  = 100
+	nodeResyncInterval       = 30 * time.Second
+)
+
+// dieEventStatuses are the Docker event statuses that mean a node
+// container is gone and should be brought back.
+var dieEventStatuses = map[string]bool{
+	"die":     true,
+	"destroy": true,
+	"oom":     true,
+}
+
+// Supervisor watches the Docker event stream on every cluster node and
+// re-creates a node container the moment it dies, is removed, or goes
+// OOM, instead of waiting for the next explicit RecreateContainers call.
+// It periodically re-diffs the cluster's node list so nodes added or
+// removed after Start was called are picked up without a restart. The
+// API server owns one Supervisor and is responsible for calling Start on
+// boot and Stop on shutdown.
+type Supervisor struct {
+	Provisioner DockerProvisioner
+
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	started  bool
+	watchers map[string]context.CancelFunc
+}
+
+// Start launches one event-watching goroutine per node currently in the
+// cluster, plus a background loop that re-diffs the cluster's node list
+// every nodeResyncInterval to start watchers for new nodes and stop them
+// for nodes that left. It's a no-op if the supervisor is already running.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.watchers = make(map[string]context.CancelFunc)
+	if err := s.syncNodesLocked(ctx); err != nil {
+		cancel()
+		return err
+	}
+	s.cancel = cancel
+	s.started = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.resyncLoop(ctx)
+	}()
+	return nil
+}
+
+// Stop cancels every running watcher and waits for them to exit. It's
+// safe to call even if Start was never called or already returned.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.started = false
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	s.wg.Wait()
+}
+
+// resyncLoop periodically re-diffs the cluster's node list against the
+// set of nodes currently being watched, until ctx is done.
+func (s *Supervisor) resyncLoop(ctx context.Context) {
+	ticker := time.NewTicker(nodeResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := s.syncNodesLocked(ctx); err != nil {
+				log.Errorf("[node containers] unable to refresh cluster node list for self-healing: %s", err)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// syncNodesLocked starts a watcher for every node in the cluster that
+// doesn't already have one, and stops the watcher for every node that's
+// no longer in the cluster. Callers must hold s.mu.
+func (s *Supervisor) syncNodesLocked(ctx context.Context) error {
+	nodes, err := s.Provisioner.Cluster().UnfilteredNodes()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(nodes))
+	for i := range nodes {
+		node := nodes[i]
+		current[node.Address] = true
+		if _, ok := s.watchers[node.Address]; ok {
+			continue
+		}
+		nodeCtx, nodeCancel := context.WithCancel(ctx)
+		s.watchers[node.Address] = nodeCancel
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watchNode(nodeCtx, &node)
+		}()
+	}
+	for addr, nodeCancel := range s.watchers {
+		if !current[addr] {
+			nodeCancel()
+			delete(s.watchers, addr)
+		}
+	}
+	return nil
+}
+
+// watchNode keeps a node's event listener alive for as long as ctx is
+// not done, reconnecting with jittered exponential backoff whenever the
+// stream drops.
+func (s *Supervisor) watchNode(ctx context.Context, node *cluster.Node) {
+	backoff := eventReconnectBackoff
+	for ctx.Err() == nil {
+		err := s.watchNodeOnce(ctx, node)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("[node containers] event listener for %s dropped, reconnecting: %s", node.Address, err)
+		}
+		if sleepErr := sleepWithContext(ctx, jittered(backoff)); sleepErr != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > maxEventReconnectBackoff {
+			backoff = maxEventReconnectBackoff
+		}
+	}
+}
+
+func (s *Supervisor) watchNodeOnce(ctx context.Context, node *cluster.Node) error {
+	client, err := dockerClient(node.Address)
+	if err != nil {
+		return err
+	}
+	listener := make(chan *docker.APIEvents, eventListenerBufferSize)
+	if err := client.AddEventListener(listener); err != nil {
+		return err
+	}
+	defer client.RemoveEventListener(listener)
+	debouncer := newEventDebouncer(eventDebounceWindow)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-listener:
+			if !ok {
+				return fmt.Errorf("event channel closed")
+			}
+			s.handleEvent(ctx, node, debouncer, event)
+		}
+	}
+}
+
+func (s *Supervisor) handleEvent(ctx context.Context, node *cluster.Node, debouncer *eventDebouncer, event *docker.APIEvents) {
+	if !dieEventStatuses[event.Status] {
+		return
+	}
+	name := strings.TrimPrefix(event.Actor.Attributes["name"], "/")
+	if name == "" {
+		return
+	}
+	pool := node.Metadata["pool"]
+	confName, ok := matchingNodeContainer(name)
+	if !ok {
+		return
+	}
+	if !debouncer.allow(node.Address + "/" + name) {
+		return
+	}
+	log.Debugf("[node containers] %s event for container %q on %s, recreating", event.Status, name, node.Address)
+	go s.recreate(ctx, node, pool, confName)
+}
+
+func (s *Supervisor) recreate(ctx context.Context, node *cluster.Node, pool, confName string) {
+	containerConfig, err := LoadNodeContainer(pool, confName)
+	if err != nil {
+		log.Errorf("[node containers] unable to reload config %q for self-healing on %s: %s", confName, node.Address, err)
+		return
+	}
+	if err := containerConfig.create(ctx, node.Address, pool, s.Provisioner, true, ioutil.Discard); err != nil {
+		log.Errorf("[node containers] self-healing recreate of %q on %s failed: %s", confName, node.Address, err)
+	}
+}
+
+// matchingNodeContainer reports whether containerName is the name of a
+// configured node container, returning the config name to reload.
+func matchingNodeContainer(containerName string) (string, bool) {
+	confNames, err := scopedconfig.FindAllScopedConfigNames(nodeContainerCollection)
+	if err != nil {
+		return "", false
+	}
+	for _, confName := range confNames {
+		if confName == containerName {
+			return confName, true
+		}
+	}
+	return "", false
+}
+
+// eventDebouncer coalesces repeated events for the same key within a
+// short window, so a container that flaps a few times in a row only
+// triggers a single recreate.
+type eventDebouncer struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[string]time.Time
+}
+
+func newEventDebouncer(window time.Duration) *eventDebouncer {
+	return &eventDebouncer{window: window, last: make(map[string]time.Time)}
+}
+
+func (d *eventDebouncer) allow(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.last[key]; ok && time.Since(last) < d.window {
+		return false
+	}
+	d.last[key] = time.Now()
+	return true
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventDebouncerAllowsFirstThenSuppresses(t *testing.T) {
+	d := newEventDebouncer(time.Minute)
+	if !d.allow("node1/bs") {
+		t.Fatal("expected first event for a key to be allowed")
+	}
+	if d.allow("node1/bs") {
+		t.Fatal("expected repeated event within the window to be suppressed")
+	}
+	if !d.allow("node1/other") {
+		t.Fatal("expected a different key to be allowed independently")
+	}
+}
+
+func TestEventDebouncerAllowsAgainAfterWindow(t *testing.T) {
+	d := newEventDebouncer(10 * time.Millisecond)
+	if !d.allow("node1/bs") {
+		t.Fatal("expected first event for a key to be allowed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !d.allow("node1/bs") {
+		t.Fatal("expected event to be allowed again once the window has elapsed")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	notaryclient "github.com/docker/notary/client"
+	"github.com/docker/notary/passphrase"
+	"github.com/docker/notary/trustpinning"
+	"github.com/docker/notary/tuf/data"
+	"github.com/tsuru/tsuru/provision/docker/nodecontainer/errdefs"
+	"github.com/tsuru/tsuru/scopedconfig"
+)
+
+const trustConfigCollection = "nodeContainerTrust"
+
+// TrustConfig enables Notary/TUF-style content trust verification before
+// a node container image is pulled and run. Node containers run
+// privileged agents on every Docker host, so an operator who overrides
+// an image tag could otherwise ship arbitrary code cluster-wide.
+type TrustConfig struct {
+	// Server is the Notary/TUF trust server URL used to resolve tags.
+	Server string
+	// RootKey is handed to the Notary client as the constant passphrase of
+	// its key retriever. The client is created with an empty
+	// trustpinning.TrustPinConfig, so RootKey does not pin the trust root.
+	RootKey string
+	// AllowedSigners maps a node container config name (e.g. "bs") to the
+	// delegation roles allowed to sign targets for that image. A pool can
+	// require different signers per node container this way. The "*"
+	// entry, if present, is the fallback applied to any config name with
+	// no entry of its own; a nil or empty map allows any signer the
+	// trust server considers valid.
+	AllowedSigners map[string][]string
+}
+
+func (t *TrustConfig) signerAllowed(confName, signer string) bool {
+	if len(t.AllowedSigners) == 0 {
+		return true
+	}
+	allowed, ok := t.AllowedSigners[confName]
+	if !ok {
+		allowed, ok = t.AllowedSigners["*"]
+	}
+	if !ok {
+		return true
+	}
+	for _, s := range allowed {
+		if s == signer {
+			return true
+		}
+	}
+	return false
+}
+
+func trustConfigFor() *scopedconfig.ScopedConfig {
+	conf := scopedconfig.FindScopedConfigFor(trustConfigCollection, "trust")
+	conf.Jsonfy = true
+	conf.AllowMapEmpty = true
+	return conf
+}
+
+// SaveTrustConfig persists the content-trust policy for pool. An empty
+// pool configures the default policy used by pools without an override.
+func SaveTrustConfig(pool string, cfg TrustConfig) error {
+	return trustConfigFor().Save(pool, &cfg)
+}
+
+// loadTrustConfig returns nil when pool has no trust policy configured;
+// callers treat that as "verification disabled", preserving the
+// pre-existing pull behavior.
+func loadTrustConfig(pool string) *TrustConfig {
+	var cfg TrustConfig
+	if err := trustConfigFor().Load(pool, &cfg); err != nil || cfg.Server == "" {
+		return nil
+	}
+	return &cfg
+}
+
+// TrustedTarget is the result of resolving an image tag against a trust
+// server: the digest it's currently pinned to and the delegation role
+// that signed it.
+type TrustedTarget struct {
+	Digest string
+	Signer string
+}
+
+// TrustResolver resolves an image tag against a trust server. It's a
+// package-level var so it can be swapped out in tests or by alternate
+// trust backends.
+var TrustResolver func(ctx context.Context, cfg *TrustConfig, image string) (*TrustedTarget, error) = resolveNotaryTarget
+
+func resolveNotaryTarget(ctx context.Context, cfg *TrustConfig, image string) (*TrustedTarget, error) {
+	repo, tag := splitImageReference(image)
+	cacheDir := filepath.Join(os.TempDir(), "tsuru-node-container-trust")
+	notaryRepo, err := notaryclient.NewFileCachedRepository(
+		cacheDir,
+		data.GUN(repo),
+		cfg.Server,
+		http.DefaultTransport,
+		passphrase.ConstantRetriever(cfg.RootKey),
+		trustpinning.TrustPinConfig{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	target, err := notaryRepo.GetTargetByName(tag)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := target.Hashes["sha256"]
+	if !ok {
+		return nil, fmt.Errorf("target %q has no sha256 hash on trust server", tag)
+	}
+	return &TrustedTarget{
+		Digest: "sha256:" + hex.EncodeToString(hash),
+		Signer: target.Role.String(),
+	}, nil
+}
+
+// splitImageReference splits an image reference into its repository and
+// tag, defaulting the tag to "latest" when none is given. It only looks
+// for a ":" after the last "/", so a registry host:port prefix is never
+// mistaken for a tag separator.
+func splitImageReference(image string) (repo string, tag string) {
+	repo, tag = image, "latest"
+	slash := strings.LastIndexByte(image, '/')
+	rest := image[slash+1:]
+	if colon := strings.IndexByte(rest, ':'); colon >= 0 {
+		tag = rest[colon+1:]
+		repo = image[:slash+1+colon]
+	}
+	return repo, tag
+}
+
+// verifyImageTrust resolves c's configured image tag against cfg,
+// refusing to proceed if there's no valid signature or the signer isn't
+// allow-listed. The first successful resolution pins PinnedImage to the
+// trusted digest; every call after that re-verifies the current trusted
+// target still matches the pin, so a rotated signer or revoked target
+// produces a classified error instead of silently running a stale
+// container.
+func (c *NodeContainerConfig) verifyImageTrust(ctx context.Context, cfg *TrustConfig) (string, error) {
+	baseImage := c.Config.Image
+	target, err := TrustResolver(ctx, cfg, baseImage)
+	if err != nil {
+		return "", errdefs.Unavailable(fmt.Errorf("unable to resolve trust for %q: %s", baseImage, err))
+	}
+	if target == nil || target.Digest == "" {
+		return "", errdefs.InvalidParameter(fmt.Errorf("image %q has no valid signature on trust server %s", baseImage, cfg.Server))
+	}
+	if !cfg.signerAllowed(c.Name, target.Signer) {
+		return "", errdefs.InvalidParameter(fmt.Errorf("image %q was signed by %q, which is not allowed for %q", baseImage, target.Signer, c.Name))
+	}
+	repo, _ := splitImageReference(baseImage)
+	trustedRef := fmt.Sprintf("%s@%s", repo, target.Digest)
+	if c.PinnedImage != "" && c.PinnedImage != trustedRef {
+		return "", errdefs.Conflict(fmt.Errorf("pinned image %q no longer matches the trusted target %q for %q; reset the pin to accept the new signed target", c.PinnedImage, trustedRef, baseImage))
+	}
+	if c.PinnedImage == "" {
+		c.PinnedImage = trustedRef
+		conf := configFor(c.Name)
+		if err := conf.SetField("", "PinnedImage", trustedRef); err != nil {
+			return "", errdefs.System(err)
+		}
+	}
+	return trustedRef, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import "testing"
+
+func TestSplitImageReference(t *testing.T) {
+	cases := []struct {
+		image    string
+		wantRepo string
+		wantTag  string
+	}{
+		{"tsuru/bs", "tsuru/bs", "latest"},
+		{"tsuru/bs:v1", "tsuru/bs", "v1"},
+		{"registry.example.com:5000/tsuru/bs", "registry.example.com:5000/tsuru/bs", "latest"},
+		{"registry.example.com:5000/tsuru/bs:v1", "registry.example.com:5000/tsuru/bs", "v1"},
+		{"bs", "bs", "latest"},
+	}
+	for _, tt := range cases {
+		repo, tag := splitImageReference(tt.image)
+		if repo != tt.wantRepo || tag != tt.wantTag {
+			t.Errorf("splitImageReference(%q) = (%q, %q), want (%q, %q)", tt.image, repo, tag, tt.wantRepo, tt.wantTag)
+		}
+	}
+}
+
+func TestTrustConfigSignerAllowed(t *testing.T) {
+	cfg := &TrustConfig{}
+	if !cfg.signerAllowed("bs", "targets/releases") {
+		t.Fatal("expected any signer to be allowed when AllowedSigners is empty")
+	}
+
+	cfg = &TrustConfig{AllowedSigners: map[string][]string{
+		"bs": {"targets/releases"},
+	}}
+	if !cfg.signerAllowed("bs", "targets/releases") {
+		t.Fatal("expected the listed signer to be allowed for bs")
+	}
+	if cfg.signerAllowed("bs", "targets/other") {
+		t.Fatal("expected a non-listed signer to be rejected for bs")
+	}
+	if !cfg.signerAllowed("other-config", "targets/anyone") {
+		t.Fatal("expected a config with no entry and no '*' fallback to allow any signer")
+	}
+
+	cfg = &TrustConfig{AllowedSigners: map[string][]string{
+		"*": {"targets/releases"},
+	}}
+	if !cfg.signerAllowed("bs", "targets/releases") {
+		t.Fatal("expected the '*' fallback to apply to a config with no specific entry")
+	}
+	if cfg.signerAllowed("bs", "targets/other") {
+		t.Fatal("expected the '*' fallback to reject a non-listed signer")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// prefixedWriter fans the progress of a single node container onto a
+// shared writer, tagging every line with a stable "[addr] [pool]
+// [confName] " prefix so output interleaved from many nodes and node
+// containers recreating in parallel stays readable. The shared mutex
+// serializes writes across every prefixedWriter pointed at the same
+// underlying writer, since callers of RecreateContainers cannot be
+// relied on to do their own interleaving-safe buffering.
+//
+// Write is fed by io.Copy over a Docker pull/create response body, so a
+// single progress line can arrive split across two Write calls at an
+// arbitrary byte boundary; buf holds whatever trailing partial line
+// hasn't seen its '\n' yet, across calls. buf belongs to this
+// prefixedWriter alone: recreateNode hands every concurrently recreated
+// confName its own prefixedWriter (only the mutex and underlying writer
+// are shared) so two containers streaming into the same node's output
+// can never splice their partial lines together.
+type prefixedWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func newPrefixedWriter(w io.Writer, mu *sync.Mutex, addr, pool, confName string) *prefixedWriter {
+	return &prefixedWriter{w: w, mu: mu, prefix: fmt.Sprintf("[%s] [%s] [%s] ", addr, pool, confName)}
+}
+
+func (p *prefixedWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		idx := bytes.IndexByte(p.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := p.buf[:idx]
+		p.buf = p.buf[idx+1:]
+		if _, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes out any remaining buffered data that never saw a trailing
+// newline, so output isn't silently dropped when the underlying stream
+// ends mid-line.
+func (p *prefixedWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+	p.buf = nil
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nodecontainer
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestPrefixedWriterSplitAcrossWrites(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	w := newPrefixedWriter(&buf, &mu, "addr1", "pool1", "bs")
+	if _, err := w.Write([]byte(`{"status":"Down`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(`loading"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := "[addr1] [pool1] [bs] {\"status\":\"Downloading\"}\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixedWriterMultipleLinesInOneWrite(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	w := newPrefixedWriter(&buf, &mu, "addr1", "pool1", "bs")
+	if _, err := w.Write([]byte("line one\nline two\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := "[addr1] [pool1] [bs] line one\n[addr1] [pool1] [bs] line two\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixedWriterFlushesTrailingPartialLine(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	w := newPrefixedWriter(&buf, &mu, "addr1", "pool1", "bs")
+	if _, err := w.Write([]byte("no newline yet")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written before a newline or Flush, got %q", buf.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "[addr1] [pool1] [bs] no newline yet\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixedWriterDoesNotSpliceConcurrentStreams(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	bsWriter := newPrefixedWriter(&buf, &mu, "addr1", "pool1", "bs")
+	sysWriter := newPrefixedWriter(&buf, &mu, "addr1", "pool1", "sysctl")
+
+	// Simulate two containers' pull progress arriving in chunks,
+	// interleaved, each split mid-line - the exact scenario that would
+	// splice content together if the two writers shared a line buffer.
+	if _, err := bsWriter.Write([]byte(`{"status":"bs-`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sysWriter.Write([]byte(`{"status":"sysctl-`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bsWriter.Write([]byte(`part"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sysWriter.Write([]byte(`part"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[addr1] [pool1] [bs] {\"status\":\"bs-part\"}\n" +
+		"[addr1] [pool1] [sysctl] {\"status\":\"sysctl-part\"}\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}